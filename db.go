@@ -0,0 +1,300 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/gob"
+	"encoding/hex"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+// DepKind mirrors the two dependency types a do-script can record:
+// ifchange (rebuild the parent if this changes) and ifcreate (rebuild the
+// parent if this is created where it didn't exist before).
+type DepKind string
+
+const (
+	DepIfChange DepKind = "ifchange"
+	DepIfCreate DepKind = "ifcreate"
+)
+
+// DepRecord is one row of the deps table: target depends on Path (relative
+// to target's directory, exactly as redo-ifchange/redo-ifcreate were called
+// with), with ExpectedDigest set for ifchange deps on non-target files.
+type DepRecord struct {
+	Path           string
+	Kind           DepKind
+	ExpectedDigest string
+}
+
+// TargetRecord is the targets table row for one absolute path: DoScript is
+// empty for a path that has only been content-pinned via stop-ifchange, and
+// non-empty once it has actually been built by a do-script.
+type TargetRecord struct {
+	Path         string
+	DoScript     string
+	LastBuiltAt  time.Time
+	OutputDigest string
+}
+
+// RunRecord is one runs table row: a single build attempt of Target.
+type RunRecord struct {
+	Target      string
+	Started     time.Time
+	Finished    time.Time
+	ExitCode    int
+	StdoutBytes int64
+}
+
+// Database is the build-state backend. It supersedes the per-target
+// .prereqs/.md5 sidecar files that used to sit next to every target:
+// NewNode, RedoIfChange, AddDep and build all go through this interface
+// instead of reading and writing those files directly, so alternative
+// backends (in-memory for tests, a real SQL database for large trees) can be
+// swapped in without touching the rest of the package.
+//
+// The default backend here is fileDatabase (below), not SQLite or BoltDB:
+// this module has no go.mod and can't vendor either without one, so the
+// schema described by this interface (targets/deps/runs, plus a revdeps
+// index) is realized as one flock-guarded file per key instead of tables in
+// an embedded database file. NewMemoryDatabase is the in-memory backend the
+// interface was written to allow; see db_test.go for both exercised against
+// the same behavior.
+type Database interface {
+	// Deps returns target's recorded dependencies, in recording order, or
+	// nil if target has never been built.
+	Deps(target string) ([]DepRecord, error)
+	// ResetDeps clears target's dependency list, so build() can start a
+	// fresh one before recording what the do-script actually touched.
+	ResetDeps(target string) error
+	// AppendDep adds one dependency record to target's list.
+	AppendDep(target string, dep DepRecord) error
+	// Target returns the stored record for an absolute path, and whether
+	// one exists.
+	Target(path string) (TargetRecord, bool, error)
+	// SetTarget upserts a target's record.
+	SetTarget(rec TargetRecord) error
+	// AppendRun records one build attempt.
+	AppendRun(run RunRecord) error
+	// Runs returns every recorded run of target, oldest first.
+	Runs(target string) ([]RunRecord, error)
+	// Dependents returns the targets whose recorded deps currently include
+	// path (given as an absolute path), i.e. answers "what depends on
+	// file X" without scanning every target's dep list.
+	Dependents(path string) ([]string, error)
+}
+
+// fileDatabase is the default Database. Rather than one gob blob covering
+// the whole tree, every target/deps/runs row lives in its own file under
+// .redo/db/<table>/<sha256(key)>, each guarded by its own flock. A build
+// touching target A never waits on a build touching target B, and reading
+// or appending to one target's records costs time proportional to that
+// target's own data, not the size of the whole database. A revdeps table,
+// keyed by the absolute path of the thing depended on rather than by
+// target, is maintained alongside deps so "what targets depend on file X"
+// is a single-key lookup instead of a linear scan of every target.
+type fileDatabase struct {
+	root string // .redo/db
+}
+
+const (
+	tableTargets = "targets"
+	tableDeps    = "deps"
+	tableRuns    = "runs"
+	tableRevdeps = "revdeps"
+)
+
+// OpenFileDatabase opens (creating if necessary) the database rooted at
+// dir/.redo/db.
+func OpenFileDatabase(dir string) (Database, error) {
+	root := filepath.Join(dir, ".redo", "db")
+	for _, table := range []string{tableTargets, tableDeps, tableRuns, tableRevdeps} {
+		if err := os.MkdirAll(filepath.Join(root, table), 0777); err != nil {
+			return nil, err
+		}
+	}
+	return &fileDatabase{root: root}, nil
+}
+
+// recordPath maps a table and key to the file that stores it. Keys are
+// arbitrary strings (absolute paths), so they're hashed into a flat,
+// filesystem-safe name rather than used as a path component directly.
+func recordPath(root, table, key string) string {
+	sum := sha256.Sum256([]byte(key))
+	return filepath.Join(root, table, hex.EncodeToString(sum[:]))
+}
+
+// withRecord opens table/key's own file, takes an exclusive flock on just
+// that file, gob-decodes its current contents into val (a pointer to a zero
+// value if the file is empty or new), and calls fn to inspect or mutate it.
+// If fn reports a change, the file is truncated and val is re-encoded back
+// before the lock is released.
+func withRecord(root, table, key string, val any, fn func() (changed bool, err error)) error {
+	path := recordPath(root, table, key)
+	f, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE, 0666)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	if err := lockFile(f); err != nil {
+		return err
+	}
+	defer unlockFile(f)
+
+	fi, err := f.Stat()
+	if err != nil {
+		return err
+	}
+	if fi.Size() > 0 {
+		if err := gob.NewDecoder(f).Decode(val); err != nil {
+			return err
+		}
+	}
+
+	changed, err := fn()
+	if err != nil || !changed {
+		return err
+	}
+	if _, err := f.Seek(0, io.SeekStart); err != nil {
+		return err
+	}
+	if err := f.Truncate(0); err != nil {
+		return err
+	}
+	if err := gob.NewEncoder(f).Encode(val); err != nil {
+		return err
+	}
+	return f.Sync()
+}
+
+func (db *fileDatabase) Deps(target string) (deps []DepRecord, err error) {
+	err = withRecord(db.root, tableDeps, target, &deps, func() (bool, error) {
+		return false, nil
+	})
+	return
+}
+
+// ResetDeps clears target's dependency list, removing target from the
+// revdeps entry of every dependency it used to have so stale reverse
+// lookups don't linger once a do-script stops touching a file.
+func (db *fileDatabase) ResetDeps(target string) error {
+	var cur, old []DepRecord
+	if err := withRecord(db.root, tableDeps, target, &cur, func() (bool, error) {
+		if len(cur) == 0 {
+			return false, nil
+		}
+		old, cur = cur, nil
+		return true, nil
+	}); err != nil {
+		return err
+	}
+	for _, dep := range old {
+		if err := db.unindexDependent(target, absDepPath(target, dep.Path)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (db *fileDatabase) AppendDep(target string, dep DepRecord) error {
+	var deps []DepRecord
+	err := withRecord(db.root, tableDeps, target, &deps, func() (bool, error) {
+		deps = append(deps, dep)
+		return true, nil
+	})
+	if err != nil {
+		return err
+	}
+	return db.indexDependent(target, absDepPath(target, dep.Path))
+}
+
+// absDepPath resolves a DepRecord's Path (relative to target's directory)
+// to an absolute path, the key revdeps indexes on.
+func absDepPath(target, relPath string) string {
+	return filepath.Join(filepath.Dir(target), relPath)
+}
+
+func (db *fileDatabase) indexDependent(target, depPath string) error {
+	var targets []string
+	return withRecord(db.root, tableRevdeps, depPath, &targets, func() (bool, error) {
+		for _, t := range targets {
+			if t == target {
+				return false, nil
+			}
+		}
+		targets = append(targets, target)
+		return true, nil
+	})
+}
+
+func (db *fileDatabase) unindexDependent(target, depPath string) error {
+	var targets []string
+	return withRecord(db.root, tableRevdeps, depPath, &targets, func() (bool, error) {
+		for i, t := range targets {
+			if t == target {
+				targets = append(targets[:i], targets[i+1:]...)
+				return true, nil
+			}
+		}
+		return false, nil
+	})
+}
+
+func (db *fileDatabase) Dependents(path string) (targets []string, err error) {
+	err = withRecord(db.root, tableRevdeps, path, &targets, func() (bool, error) {
+		return false, nil
+	})
+	return
+}
+
+func (db *fileDatabase) Target(path string) (rec TargetRecord, ok bool, err error) {
+	err = withRecord(db.root, tableTargets, path, &rec, func() (bool, error) {
+		ok = rec.Path != ""
+		return false, nil
+	})
+	return
+}
+
+func (db *fileDatabase) SetTarget(rec TargetRecord) error {
+	var cur TargetRecord
+	return withRecord(db.root, tableTargets, rec.Path, &cur, func() (bool, error) {
+		cur = rec
+		return true, nil
+	})
+}
+
+func (db *fileDatabase) AppendRun(run RunRecord) error {
+	var runs []RunRecord
+	return withRecord(db.root, tableRuns, run.Target, &runs, func() (bool, error) {
+		runs = append(runs, run)
+		return true, nil
+	})
+}
+
+func (db *fileDatabase) Runs(target string) (runs []RunRecord, err error) {
+	err = withRecord(db.root, tableRuns, target, &runs, func() (bool, error) {
+		return false, nil
+	})
+	return
+}
+
+var (
+	theDBOnce sync.Once
+	theDB     Database
+)
+
+// database returns the process-wide build database, opening it on first use.
+func database() Database {
+	theDBOnce.Do(func() {
+		var err error
+		theDB, err = OpenFileDatabase(".")
+		if err != nil {
+			log.Fatalln("could not open build database:", err)
+		}
+	})
+	return theDB
+}
@@ -0,0 +1,102 @@
+package main
+
+import "sync"
+
+// memoryDatabase is an in-process Database backed by plain maps, guarded by
+// a single mutex. It exists for tests that want a Database without touching
+// disk or flock: unlike fileDatabase, nothing here survives the process, and
+// there is no need to shard by key since there's no cross-process contention
+// to avoid.
+type memoryDatabase struct {
+	mu      sync.Mutex
+	targets map[string]TargetRecord
+	deps    map[string][]DepRecord
+	runs    map[string][]RunRecord
+	revdeps map[string][]string
+}
+
+// NewMemoryDatabase returns an empty in-memory Database.
+func NewMemoryDatabase() Database {
+	return &memoryDatabase{
+		targets: make(map[string]TargetRecord),
+		deps:    make(map[string][]DepRecord),
+		runs:    make(map[string][]RunRecord),
+		revdeps: make(map[string][]string),
+	}
+}
+
+func (db *memoryDatabase) Deps(target string) ([]DepRecord, error) {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	return append([]DepRecord(nil), db.deps[target]...), nil
+}
+
+func (db *memoryDatabase) ResetDeps(target string) error {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	for _, dep := range db.deps[target] {
+		db.unindexDependentLocked(target, absDepPath(target, dep.Path))
+	}
+	delete(db.deps, target)
+	return nil
+}
+
+func (db *memoryDatabase) AppendDep(target string, dep DepRecord) error {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	db.deps[target] = append(db.deps[target], dep)
+	db.indexDependentLocked(target, absDepPath(target, dep.Path))
+	return nil
+}
+
+func (db *memoryDatabase) indexDependentLocked(target, depPath string) {
+	for _, t := range db.revdeps[depPath] {
+		if t == target {
+			return
+		}
+	}
+	db.revdeps[depPath] = append(db.revdeps[depPath], target)
+}
+
+func (db *memoryDatabase) unindexDependentLocked(target, depPath string) {
+	targets := db.revdeps[depPath]
+	for i, t := range targets {
+		if t == target {
+			db.revdeps[depPath] = append(targets[:i], targets[i+1:]...)
+			return
+		}
+	}
+}
+
+func (db *memoryDatabase) Dependents(path string) ([]string, error) {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	return append([]string(nil), db.revdeps[path]...), nil
+}
+
+func (db *memoryDatabase) Target(path string) (TargetRecord, bool, error) {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	rec, ok := db.targets[path]
+	return rec, ok, nil
+}
+
+func (db *memoryDatabase) SetTarget(rec TargetRecord) error {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	db.targets[rec.Path] = rec
+	return nil
+}
+
+func (db *memoryDatabase) AppendRun(run RunRecord) error {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	db.runs[run.Target] = append(db.runs[run.Target], run)
+	return nil
+}
+
+func (db *memoryDatabase) Runs(target string) ([]RunRecord, error) {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	return append([]RunRecord(nil), db.runs[target]...), nil
+}
@@ -0,0 +1,73 @@
+package main
+
+import "testing"
+
+// databaseBackends is every Database implementation that should behave
+// identically from the caller's point of view.
+func databaseBackends(t *testing.T) map[string]Database {
+	t.Helper()
+	fdb, err := OpenFileDatabase(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	return map[string]Database{
+		"file":   fdb,
+		"memory": NewMemoryDatabase(),
+	}
+}
+
+func TestDatabaseDependents(t *testing.T) {
+	for name, db := range databaseBackends(t) {
+		t.Run(name, func(t *testing.T) {
+			if err := db.AppendDep("/a", DepRecord{Path: "x", Kind: DepIfChange}); err != nil {
+				t.Fatal(err)
+			}
+			if err := db.AppendDep("/b", DepRecord{Path: "x", Kind: DepIfChange}); err != nil {
+				t.Fatal(err)
+			}
+
+			got, err := db.Dependents("/x")
+			if err != nil {
+				t.Fatal(err)
+			}
+			want := map[string]bool{"/a": true, "/b": true}
+			if len(got) != len(want) {
+				t.Fatalf("Dependents(/x) = %v, want %v", got, want)
+			}
+			for _, t2 := range got {
+				if !want[t2] {
+					t.Fatalf("Dependents(/x) = %v, want %v", got, want)
+				}
+			}
+
+			if err := db.ResetDeps("/a"); err != nil {
+				t.Fatal(err)
+			}
+			got, err = db.Dependents("/x")
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(got) != 1 || got[0] != "/b" {
+				t.Fatalf("Dependents(/x) after ResetDeps(/a) = %v, want [/b]", got)
+			}
+		})
+	}
+}
+
+func TestDatabaseTargetRoundtrip(t *testing.T) {
+	for name, db := range databaseBackends(t) {
+		t.Run(name, func(t *testing.T) {
+			if _, ok, err := db.Target("/missing"); err != nil || ok {
+				t.Fatalf("Target(/missing) = ok=%v, err=%v, want ok=false, err=nil", ok, err)
+			}
+			rec := TargetRecord{Path: "/a", DoScript: "/a.do", OutputDigest: "sha256:deadbeef"}
+			if err := db.SetTarget(rec); err != nil {
+				t.Fatal(err)
+			}
+			got, ok, err := db.Target("/a")
+			if err != nil || !ok || got != rec {
+				t.Fatalf("Target(/a) = %+v, ok=%v, err=%v, want %+v, ok=true, err=nil", got, ok, err, rec)
+			}
+		})
+	}
+}
@@ -1,9 +1,11 @@
 package main
 
 import (
-	"bufio"
+	"bytes"
 	"context"
+	"encoding/hex"
 	"fmt"
+	"io"
 	"log"
 	"os"
 	"os/exec"
@@ -18,24 +20,50 @@ type Node struct {
 	// Filesystem attributes of the node
 	Dir, File, DoScript                    string
 	IsTarget, Exists, IsDir, UsesDefaultDo bool
+	AbsPath                                string
 
 	// internal state
 	lockFile *os.File
 }
 
+// builtThisRun records, by absolute path, every target this process has
+// already finished building during the current invocation. Lock() consults
+// it for the "already built, nothing to do" fast path instead of comparing
+// the .prereqs file's mtime against RedoTreeTime, which raced against a peer
+// that had just started rebuilding the same target.
+var (
+	builtMu      sync.Mutex
+	builtThisRun = make(map[string]bool)
+)
+
+func alreadyBuilt(path string) bool {
+	builtMu.Lock()
+	defer builtMu.Unlock()
+	return builtThisRun[path]
+}
+
+func markBuilt(path string) {
+	builtMu.Lock()
+	defer builtMu.Unlock()
+	builtThisRun[path] = true
+}
+
 // Takes a path to a node and returns a *Node
 func NewNode(path string) (n *Node, err error) {
 	n = &Node{}
 	n.Dir, n.File = filepath.Split(path)
+	if n.AbsPath, err = filepath.Abs(path); err != nil {
+		return
+	}
 	var s os.FileInfo
 
-	if s, err = os.Stat(path + ".prereqs"); err == nil {
-		n.IsTarget = true
-	} else if os.IsNotExist(err) {
-		err = nil
-	} else {
+	rec, known, err := database().Target(n.AbsPath)
+	if err != nil {
 		return
 	}
+	if known && rec.DoScript != "" {
+		n.IsTarget = true
+	}
 
 	if s, err = os.Stat(path); err == nil {
 		n.Exists = true
@@ -65,7 +93,7 @@ func NewNode(path string) (n *Node, err error) {
 	}
 
 	if n.IsTarget && n.DoScript == "" {
-		err = fmt.Errorf("file %s has .prereqs but no do exec", path)
+		err = fmt.Errorf("file %s has a build record but no do exec", path)
 		return
 	}
 	return
@@ -86,20 +114,17 @@ func (n *Node) RedoIfChange(ctx context.Context, cancelCause context.CancelCause
 	if !n.Exists {
 		return true, n.build(ctx)
 	}
-	f, err := os.Open(n.Dir + n.File + ".prereqs")
+	deps, err := database().Deps(n.AbsPath)
 	if err != nil {
 		return
 	}
-	defer f.Close()
-	scanner := bufio.NewScanner(f)
-	var line []string
 	var o *Node
 	var hashChanged bool
 	var wg sync.WaitGroup
-	for scanner.Scan() {
-		line = strings.Split(scanner.Text(), "	")
-		if line[1] == "ifcreate" {
-			o, err = NewNode(n.Dir + line[0])
+	errs := make(chan error, len(deps))
+	for _, dep := range deps {
+		if dep.Kind == DepIfCreate {
+			o, err = NewNode(n.Dir + dep.Path)
 			if err != nil {
 				return
 			}
@@ -112,16 +137,16 @@ func (n *Node) RedoIfChange(ctx context.Context, cancelCause context.CancelCause
 			}
 			continue
 		}
-		if line[1] != "ifchange" {
-			err = fmt.Errorf("Unknown dependency type: %s", line[1])
+		if dep.Kind != DepIfChange {
+			err = fmt.Errorf("Unknown dependency type: %s", dep.Kind)
 			return
 		}
-		o, err = NewNode(n.Dir + line[0])
+		o, err = NewNode(n.Dir + dep.Path)
 		if err != nil {
 			return
 		}
 		if !o.IsTarget {
-			hashChanged, err = o.HashChanged(line[2])
+			hashChanged, err = o.HashChanged(dep.ExpectedDigest)
 			if err != nil {
 				return
 			}
@@ -135,7 +160,7 @@ func (n *Node) RedoIfChange(ctx context.Context, cancelCause context.CancelCause
 			}
 			continue
 		}
-		hashChanged, err = o.HashChanged(line[2])
+		hashChanged, err = o.HashChanged(dep.ExpectedDigest)
 		if err != nil {
 			return
 		}
@@ -143,18 +168,28 @@ func (n *Node) RedoIfChange(ctx context.Context, cancelCause context.CancelCause
 			err = fmt.Errorf("hash changed since last build")
 			return
 		}
+		if err = Jobs.Walk.AcquireCtx(ctx); err != nil {
+			return
+		}
 		wg.Add(1)
 		go func(n *Node) {
 			defer wg.Done()
-			_, err = n.RedoIfChange(ctx, cancelCause)
-			if err != nil {
-				cancelCause(err)
-				return
+			defer Jobs.Walk.Release()
+			_, depErr := n.RedoIfChange(ctx, cancelCause)
+			if depErr != nil {
+				cancelCause(depErr)
 			}
+			errs <- depErr
 		}(o)
 	}
 	wg.Wait()
-	if err = scanner.Err(); err != nil {
+	close(errs)
+	for depErr := range errs {
+		if depErr != nil && err == nil {
+			err = depErr
+		}
+	}
+	if err != nil {
 		return
 	}
 	if changed {
@@ -176,54 +211,65 @@ func (n *Node) RedoIfCreate() (bool, error) {
 	}
 }
 
+// StopIfChange pins the current content hash of a source file in the build
+// database, and fails if a previously pinned hash no longer matches.
 func (n *Node) StopIfChange() (err error) {
 	if !n.Exists {
 		err = fmt.Errorf("file does not exist")
 		return
 	}
-	new_hash, err := n.Hash()
-	if _, err = os.Stat(n.Dir + n.File + ".md5"); err == nil {
-		old_hash, err := os.ReadFile(n.Dir + n.File + ".md5")
-		if err != nil {
-			return err
-		}
-		if strings.HasPrefix(string(old_hash), new_hash) {
-			return nil
-		} else {
-			err = fmt.Errorf("Hash changed since last build: %s", n.Dir+n.File)
-			return err
-		}
-	} else if os.IsNotExist(err) {
-		log.Printf("hashing \"%s\" for the first time, integrity will be preserved hereafter.\n", n.Dir+n.File)
-		md5File, err := os.Create(n.Dir + n.File + ".md5")
-		if err != nil {
-			return fmt.Errorf("unable to write hash for %s:", n.Dir+n.File, err)
-		}
-		defer md5File.Close()
-		_, err = fmt.Fprintf(md5File, "%s	%s\n", new_hash, n.File)
-		if err != nil {
-			return fmt.Errorf("unable to write hash for %s:", n.Dir+n.File, err)
-		}
-		return nil
-	} else {
+	newHash, err := n.Hash()
+	if err != nil {
 		return err
 	}
+	rec, known, err := database().Target(n.AbsPath)
+	if err != nil {
+		return err
+	}
+	if known {
+		if rec.OutputDigest == newHash {
+			return nil
+		}
+		return fmt.Errorf("Hash changed since last build: %s", n.Dir+n.File)
+	}
+	log.Printf("hashing \"%s\" for the first time, integrity will be preserved hereafter.\n", n.Dir+n.File)
+	return database().SetTarget(TargetRecord{
+		Path:         n.AbsPath,
+		OutputDigest: newHash,
+		LastBuiltAt:  time.Now(),
+	})
 }
 
-// Check if hash has changed since last build
+// HashChanged reports whether the node's content no longer matches a
+// previously recorded "<algo>:<digest>" hash. It re-hashes using whichever
+// algorithm produced the recorded value, not necessarily DefaultHasher, so a
+// tree with a mix of old and new algorithm records verifies correctly and
+// each target migrates to the current algorithm the next time it rebuilds.
 func (n *Node) HashChanged(lastHash string) (bool, error) {
-	h, err := n.Hash()
+	algo, _, ok := strings.Cut(lastHash, ":")
+	if !ok {
+		return false, fmt.Errorf("malformed hash record: %q", lastHash)
+	}
+	h, err := hasherByName(algo)
+	if err != nil {
+		return false, err
+	}
+	current, err := n.hashWith(h)
 	if err != nil {
 		return false, err
 	}
-	return h != lastHash, nil
+	return current != lastHash, nil
 }
 
 func (n *Node) Hash() (string, error) {
+	return n.hashWith(DefaultHasher)
+}
+
+func (n *Node) hashWith(h Hasher) (string, error) {
 	if n.IsDir {
-		return MD5SumDir(n.Dir + n.File)
+		return HashDir(h, n.Dir+n.File)
 	} else {
-		return MD5SumFile(n.Dir + n.File)
+		return HashFile(h, n.Dir+n.File)
 	}
 }
 
@@ -235,12 +281,31 @@ func (n *Node) build(ctx context.Context) (err error) {
 	}
 	defer n.UnLock()
 	fmt.Fprintln(os.Stderr, "redo", n.Dir+n.File)
+	started := time.Now()
+	var stdoutSize int64
+	defer func() {
+		exitCode := 0
+		if err != nil {
+			exitCode = 1
+		}
+		if runErr := database().AppendRun(RunRecord{
+			Target:      n.AbsPath,
+			Started:     started,
+			Finished:    time.Now(),
+			ExitCode:    exitCode,
+			StdoutBytes: stdoutSize,
+		}); runErr != nil && err == nil {
+			err = runErr
+		}
+	}()
 
-	prereqsFile, err := os.Create(n.Dir + n.File + ".prereqs")
+	prevDeps, err := database().Deps(n.AbsPath)
 	if err != nil {
-		return fmt.Errorf("could not create prereqs file: %v", err)
+		return fmt.Errorf("could not read previous deps: %v", err)
+	}
+	if err = database().ResetDeps(n.AbsPath); err != nil {
+		return fmt.Errorf("could not reset deps: %v", err)
 	}
-	defer prereqsFile.Close()
 
 	do, err := NewNode(n.Dir + n.DoScript)
 	if err != nil {
@@ -250,45 +315,93 @@ func (n *Node) build(ctx context.Context) (err error) {
 	if err != nil {
 		return fmt.Errorf("unable to hash do exec: %v", err)
 	}
-	_, err = fmt.Fprintf(prereqsFile, "%s	ifchange	%s\n",
-		do.File,
-		h)
-	if err != nil {
+	if err = database().AppendDep(n.AbsPath, DepRecord{Path: do.File, Kind: DepIfChange, ExpectedDigest: h}); err != nil {
 		return
 	}
+
 	if n.UsesDefaultDo {
-		_, err = fmt.Fprintf(prereqsFile, "%s	ifcreate\n", n.File+".do")
-		if err != nil {
+		if err = database().AppendDep(n.AbsPath, DepRecord{Path: n.File + ".do", Kind: DepIfCreate}); err != nil {
 			err = fmt.Errorf("unable to add ifcreate dep for non-default do: %v", err)
 			return
 		}
 	}
 
-	// Set RedoParentEnv
-	parent, err := filepath.Abs(n.Dir + n.File)
-	if err != nil {
-		return
+	// A remote cache GET is only trustworthy once we can key on the content
+	// the do-script is actually about to read: prevDeps tells us which paths
+	// were read last time, but its ExpectedDigest values are whatever they
+	// were at the end of that build, which is stale the moment any of them
+	// changes (exactly the case that triggered this rebuild). liveDeps
+	// re-hashes those paths right now; an empty prevDeps (first-ever build,
+	// nothing to re-hash) or a dependency that's vanished since just means
+	// there's nothing safe to key on yet, so the GET is skipped and this
+	// build falls through to running the do-script locally.
+	cache := cacheFromEnv()
+	var getCacheKey string
+	var liveDeps []DepRecord
+	if cache != nil && len(prevDeps) > 0 {
+		if live, lerr := n.liveDeps(prevDeps); lerr == nil {
+			liveDeps = live
+			getCacheKey = computeCacheKey(n.AbsPath, h, live)
+		}
 	}
+
+	// Set RedoParentEnv
 	env := os.Environ()
 	var inserted bool
 	for i, e := range env {
 		if strings.HasPrefix(e, RedoParentEnv) {
-			env[i] = RedoParentEnv + "=" + parent
+			env[i] = RedoParentEnv + "=" + n.AbsPath
 			inserted = true
 		}
 	}
 	if !inserted {
-		env = append(env, RedoParentEnv+"="+parent)
+		env = append(env, RedoParentEnv+"="+n.AbsPath)
+	}
+
+	stageDir, err := newStageDir()
+	if err != nil {
+		return fmt.Errorf("could not create staging dir: %v", err)
 	}
+	defer os.RemoveAll(stageDir)
 
-	tmpStdout := n.Dir + "redo-stdout---" + n.File
-	redoArg3 := "redo-redoArg3---" + n.File
+	tmpStdout := filepath.Join(stageDir, "stdout")
+	redoArg3 := filepath.Join(stageDir, "arg3")
 	tmpStdoutFile, err := os.Create(tmpStdout)
 	if err != nil {
 		return
 	}
 	defer tmpStdoutFile.Close()
-	defer os.Remove(tmpStdout)
+
+	if cache != nil && getCacheKey != "" {
+		hit, gerr := cache.Get(getCacheKey, tmpStdoutFile)
+		if gerr != nil {
+			fmt.Fprintln(os.Stderr, "redo: remote cache GET failed, building locally:", gerr)
+		} else if hit {
+			if err = tmpStdoutFile.Sync(); err != nil {
+				return
+			}
+			if err = os.Rename(tmpStdout, n.Dir+n.File); err != nil {
+				return
+			}
+			if err = fsyncDir(n.Dir); err != nil {
+				return
+			}
+			// Replay liveDeps (the re-hashed set the GET key was actually
+			// computed from) rather than layering it on top of the do-script
+			// dep already appended above, or the stale prevDeps: liveDeps is
+			// the exact, just-verified dependency content that produced this
+			// cached artifact.
+			if err = database().ResetDeps(n.AbsPath); err != nil {
+				return
+			}
+			for _, dep := range liveDeps {
+				if err = database().AppendDep(n.AbsPath, dep); err != nil {
+					return
+				}
+			}
+			return n.recordBuilt()
+		}
+	}
 
 	c := exec.CommandContext(
 		ctx,
@@ -298,38 +411,71 @@ func (n *Node) build(ctx context.Context) (err error) {
 		redoArg3)
 	c.Dir = n.Dir
 	c.Stdout = tmpStdoutFile
-	c.Stderr = os.Stderr
+	var stderrBuf bytes.Buffer
+	if cache != nil {
+		// Tee stderr so a successful build's output digest can go into the
+		// cache manifest without losing the usual live stderr streaming.
+		c.Stderr = io.MultiWriter(os.Stderr, &stderrBuf)
+	} else {
+		c.Stderr = os.Stderr
+	}
 	c.Env = env
+	if js, ok := Jobs.Work.(*jobserverGate); ok {
+		// Hand the jobserver pipe down so a do-script that calls back into
+		// redo-ifchange shares the same job budget instead of starting a
+		// fresh, unbounded one.
+		c.ExtraFiles = []*os.File{js.r, js.w}
+	}
 	c.Cancel = func() error {
 		return c.Process.Signal(os.Interrupt)
 	}
-	if err = c.Run(); err != nil {
+	if err = Jobs.Work.AcquireCtx(ctx); err != nil {
+		return
+	}
+	defer Jobs.Work.Release()
+	var tracedExisting, tracedMissing []string
+	if os.Getenv(RedoTraceEnv) != "" {
+		tracedExisting, tracedMissing, err = selectTracer().Trace(c)
+	} else {
+		err = c.Run()
+	}
+	if err != nil {
 		return fmt.Errorf("failed while rebuilding: %v", err)
 	}
+	if err = n.recordTracedDeps(tracedExisting, tracedMissing); err != nil {
+		return fmt.Errorf("could not record traced deps: %v", err)
+	}
 
 	stdoutStat, err := os.Stat(tmpStdout)
 	if err != nil {
 		return
 	}
-	stdoutSize := stdoutStat.Size()
+	stdoutSize = stdoutStat.Size()
 
-	arg3 := false
-	if _, err = os.Stat(n.Dir + redoArg3); err == nil {
-		arg3 = true
-	} else if os.IsNotExist(err) {
-		err = nil
-	} else {
-		return
+	arg3Stat, statErr := os.Lstat(redoArg3)
+	arg3 := statErr == nil
+	if statErr != nil && !os.IsNotExist(statErr) {
+		return statErr
 	}
 
 	if arg3 && stdoutSize > 0 {
 		return fmt.Errorf("do program wrote to stdout and to $3")
 	}
+	if arg3 && !arg3Stat.Mode().IsRegular() && !arg3Stat.IsDir() {
+		return fmt.Errorf("do program produced $3 as neither a regular file nor a directory")
+	}
 	if stdoutSize > 0 {
 		if err = tmpStdoutFile.Sync(); err != nil {
 			return
 		}
-		return os.Rename(tmpStdout, n.Dir+n.File)
+		if err = os.Rename(tmpStdout, n.Dir+n.File); err != nil {
+			return
+		}
+		if err = fsyncDir(n.Dir); err != nil {
+			return
+		}
+		n.putCache(cache, h, stderrBuf.Bytes())
+		return n.recordBuilt()
 	}
 	if arg3 {
 		if n.Exists && n.IsDir {
@@ -337,69 +483,212 @@ func (n *Node) build(ctx context.Context) (err error) {
 				return
 			}
 		}
-		err = filepath.Walk(n.Dir+redoArg3, func(path string, info os.FileInfo, err error) error {
+		err = filepath.Walk(redoArg3, func(path string, info os.FileInfo, err error) error {
 			if err != nil {
 				return err
 			}
+			if !info.Mode().IsRegular() {
+				return nil
+			}
 			file, err := os.Open(path)
 			if err != nil {
 				return err
 			}
 			defer file.Close()
-			if err = file.Sync(); err != nil {
-				return err
-			}
-			return nil
+			return file.Sync()
 		})
 		if err != nil {
 			return
 		}
-		err = os.Rename(n.Dir+redoArg3, n.Dir+n.File)
+		if err = os.Rename(redoArg3, n.Dir+n.File); err != nil {
+			return
+		}
+		if err = fsyncDir(n.Dir); err != nil {
+			return
+		}
+		n.putCache(cache, h, stderrBuf.Bytes())
+		return n.recordBuilt()
 	}
 	return
 }
 
+// putCache opportunistically uploads n's freshly built artifact to cache,
+// keyed from the dependency set this build just recorded rather than
+// whatever was on record before it ran, so the key reflects the content the
+// do-script actually just read. A nil cache, a directory artifact (the
+// cache only stores single blobs), or any upload error is logged and
+// otherwise ignored: the remote cache is an optimization, never a
+// build-correctness dependency.
+func (n *Node) putCache(cache RemoteCache, doHash string, stderr []byte) {
+	if cache == nil {
+		return
+	}
+	info, err := os.Stat(n.Dir + n.File)
+	if err != nil || info.IsDir() {
+		return
+	}
+	f, err := os.Open(n.Dir + n.File)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "redo: remote cache PUT skipped, could not reopen artifact:", err)
+		return
+	}
+	defer f.Close()
+
+	deps, err := database().Deps(n.AbsPath)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "redo: remote cache PUT skipped:", err)
+		return
+	}
+	key := computeCacheKey(n.AbsPath, doHash, deps)
+	h := DefaultHasher.New()
+	h.Write(stderr)
+	manifest := CacheManifest{
+		Deps:         deps,
+		ExitCode:     0,
+		StderrDigest: hex.EncodeToString(h.Sum(nil)),
+	}
+	if err := cache.Put(key, manifest, f); err != nil {
+		fmt.Fprintln(os.Stderr, "redo: remote cache PUT failed:", err)
+	}
+}
+
+// recordBuilt upserts the target's record in the build database after a
+// successful build, hashing the freshly written output so the next
+// RedoIfChange can detect whether it changed again without a rebuild.
+func (n *Node) recordBuilt() error {
+	info, err := os.Stat(n.Dir + n.File)
+	if err != nil {
+		return err
+	}
+	var digest string
+	if info.IsDir() {
+		digest, err = HashDir(DefaultHasher, n.Dir+n.File)
+	} else {
+		digest, err = HashFile(DefaultHasher, n.Dir+n.File)
+	}
+	if err != nil {
+		return err
+	}
+	return database().SetTarget(TargetRecord{
+		Path:         n.AbsPath,
+		DoScript:     n.DoScript,
+		LastBuiltAt:  time.Now(),
+		OutputDigest: digest,
+	})
+}
+
+// Lock acquires the exclusive right to rebuild n, blocking on the OS-level
+// advisory lock (rather than polling) if a peer is already rebuilding it.
+// done is true if nothing further needs to happen: either this process
+// already rebuilt n earlier in the same invocation, or a peer finished
+// rebuilding it while we were waiting for the lock.
 func (n *Node) Lock() (done bool, err error) {
-	if _, err = os.Stat(n.Dir + n.File + ".lock"); err == nil {
-		for {
-			time.Sleep(time.Second)
-			if _, err = os.Stat(n.Dir + n.File + ".lock"); os.IsNotExist(err) {
-				return true, nil
-			}
-			log.Printf("waiting for %s...\n", n.Dir+n.File)
+	if alreadyBuilt(n.AbsPath) {
+		return true, nil
+	}
+
+	f, err := os.OpenFile(n.Dir+n.File+".lock", os.O_RDWR|os.O_CREATE, 0666)
+	if err != nil {
+		return false, fmt.Errorf("could not open lock file: %v", err)
+	}
+	if err = lockFile(f); err != nil {
+		f.Close()
+		return false, fmt.Errorf("could not lock %s: %v", n.Dir+n.File, err)
+	}
+
+	// We now hold the lock. If a peer rebuilt n while we waited for it, our
+	// own in-memory record of that (set by its UnLock) makes this a no-op.
+	if alreadyBuilt(n.AbsPath) {
+		f.Close()
+		return true, nil
+	}
+
+	if err = f.Truncate(0); err != nil {
+		f.Close()
+		return false, err
+	}
+	if _, err = fmt.Fprintf(f, "%d %d\n", os.Getpid(), time.Now().Unix()); err != nil {
+		f.Close()
+		return false, err
+	}
+	n.lockFile = f
+	return false, nil
+}
+
+func (n *Node) UnLock() (err error) {
+	markBuilt(n.AbsPath)
+	if err = unlockFile(n.lockFile); err != nil {
+		n.lockFile.Close()
+		return
+	}
+	return n.lockFile.Close()
+}
+
+// writeDepsDot writes n's dependency graph to w in Graphviz DOT format,
+// recursing into dependencies that are themselves targets. seen is keyed by
+// absolute path and shared across the top-level targets passed to redo-deps
+// so that a diamond or cycle in the graph is only visited, and only printed,
+// once.
+func writeDepsDot(w io.Writer, n *Node, seen map[string]bool) error {
+	if seen[n.AbsPath] {
+		return nil
+	}
+	seen[n.AbsPath] = true
+
+	deps, err := database().Deps(n.AbsPath)
+	if err != nil {
+		return err
+	}
+	for _, dep := range deps {
+		o, err := NewNode(n.Dir + dep.Path)
+		if err != nil {
+			return err
 		}
-	} else if os.IsNotExist(err) {
-		var prereqsStat os.FileInfo
-		if prereqsStat, err = os.Stat(n.Dir + n.File + ".prereqs"); err == nil {
-			if prereqsStat.ModTime().After(RedoTreeTime) {
-				return true, nil
+		fmt.Fprintf(w, "\t%q -> %q [label=%q];\n", n.Dir+n.File, o.Dir+o.File, dep.Kind)
+		if o.IsTarget {
+			if err := writeDepsDot(w, o, seen); err != nil {
+				return err
 			}
-		} else if !os.IsNotExist(err) {
-			return
-		}
-		n.lockFile, err = os.Create(n.Dir + n.File + ".lock")
-		if err != nil {
-			return false, fmt.Errorf("could not create lock file: %v", err)
 		}
 	}
-	return
+	return nil
 }
 
-func (n *Node) UnLock() (err error) {
-	err = n.lockFile.Close()
-	if err != nil {
-		return
+// liveDeps returns a copy of deps with every ifchange dependency's
+// ExpectedDigest replaced by a fresh hash of that path's current on-disk
+// content, so a remote-cache key built from it reflects what the do-script
+// is actually about to read instead of whatever was last recorded. It
+// errors if any ifchange dependency can no longer be hashed (e.g. deleted
+// since the last build), since a partial re-hash isn't a trustworthy key.
+func (n *Node) liveDeps(deps []DepRecord) ([]DepRecord, error) {
+	live := make([]DepRecord, len(deps))
+	for i, dep := range deps {
+		live[i] = dep
+		if dep.Kind != DepIfChange {
+			continue
+		}
+		o, err := NewNode(n.Dir + dep.Path)
+		if err != nil {
+			return nil, err
+		}
+		digest, err := o.Hash()
+		if err != nil {
+			return nil, err
+		}
+		live[i].ExpectedDigest = digest
 	}
-	return os.Remove(n.Dir + n.File + ".lock")
+	return live, nil
 }
 
-func (n *Node) AddDep(prereqsFile *os.File) (err error) {
+// AddDep records n as an ifchange dependency of the target at parentAbsPath.
+func (n *Node) AddDep(parentAbsPath string) (err error) {
 	h, err := n.Hash()
 	if err != nil {
 		return fmt.Errorf("unable to hash: %v", err)
 	}
-	_, err = fmt.Fprintf(prereqsFile, "%s	ifchange	%s\n",
-		n.Dir+n.File,
-		h)
-	return
+	return database().AppendDep(parentAbsPath, DepRecord{
+		Path:           n.Dir + n.File,
+		Kind:           DepIfChange,
+		ExpectedDigest: h,
+	})
 }
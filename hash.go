@@ -0,0 +1,60 @@
+package main
+
+import (
+	"crypto/md5"
+	"crypto/sha256"
+	"fmt"
+	"hash"
+	"os"
+)
+
+// Hasher selects the digest algorithm used to fingerprint file and directory
+// content. Persisted hash records carry the algorithm's Name() as a prefix
+// (e.g. "sha256:abcd..."), so records written under one Hasher remain
+// verifiable even after the default changes.
+type Hasher interface {
+	// Name is the algorithm identifier stored as the prefix of a hash record.
+	Name() string
+	// New returns a fresh hash.Hash for this algorithm.
+	New() hash.Hash
+}
+
+type md5Hasher struct{}
+
+func (md5Hasher) Name() string   { return "md5" }
+func (md5Hasher) New() hash.Hash { return md5.New() }
+
+type sha256Hasher struct{}
+
+func (sha256Hasher) Name() string   { return "sha256" }
+func (sha256Hasher) New() hash.Hash { return sha256.New() }
+
+// DefaultHasher is the algorithm used for new hash records, selected once at
+// startup from REDOHASH (sha256|md5). It defaults to sha256.
+var DefaultHasher Hasher = selectHasher(os.Getenv("REDOHASH"))
+
+func selectHasher(name string) Hasher {
+	switch name {
+	case "", "sha256":
+		return sha256Hasher{}
+	case "md5":
+		return md5Hasher{}
+	default:
+		fmt.Fprintf(os.Stderr, "redo: unknown REDOHASH %q, falling back to sha256\n", name)
+		return sha256Hasher{}
+	}
+}
+
+// hasherByName looks up the Hasher matching a persisted algorithm prefix, so
+// a hash record can always be verified with the algorithm that produced it,
+// regardless of what DefaultHasher currently points at.
+func hasherByName(name string) (Hasher, error) {
+	switch name {
+	case "md5":
+		return md5Hasher{}, nil
+	case "sha256":
+		return sha256Hasher{}, nil
+	default:
+		return nil, fmt.Errorf("unknown hash algorithm: %s", name)
+	}
+}
@@ -0,0 +1,151 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+)
+
+// HashFile computes the content hash of a single file under h, formatted as
+// "<algo>:<hex digest>".
+func HashFile(h Hasher, path string) (sum string, err error) {
+	digest, err := hashFile(h, path)
+	if err != nil {
+		return
+	}
+	sum = fmt.Sprintf("%s:%x", h.Name(), digest)
+	return
+}
+
+func hashFile(h Hasher, path string) ([]byte, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	hh := h.New()
+	if _, err := io.Copy(hh, f); err != nil {
+		return nil, err
+	}
+	return hh.Sum(nil), nil
+}
+
+// treeEntry is one (name, mode, digest) tuple combined into its parent
+// directory's node digest.
+type treeEntry struct {
+	name   string
+	mode   os.FileMode
+	digest []byte
+}
+
+// HashDir computes a Merkle-style content hash of a directory tree under h:
+// each regular file is hashed individually, then every directory (innermost
+// first) combines the sorted (name, mode, digest) tuples of its direct
+// entries into its own node digest. The result is the root directory's
+// digest, formatted as "<algo>:<hex digest>", so a change to any file, or the
+// addition/removal/rename of any entry, changes the digest of every
+// enclosing directory up to the root.
+func HashDir(h Hasher, path string) (sum string, err error) {
+	digest, err := hashTree(h, path)
+	if err != nil {
+		return
+	}
+	sum = fmt.Sprintf("%s:%x", h.Name(), digest)
+	return
+}
+
+// hashTree hashes dir's entries through a fixed-size pool of digester
+// goroutines pulling from a jobs channel, mirroring the bounded
+// pipeline-plus-done-channel shape of the old md5All helper: recursing into
+// a subdirectory holds a Jobs.Walk slot, and opening a file to hash it holds
+// a Jobs.Work slot, so a directory hash respects the same invocation-wide
+// concurrency budget as dependency walking and do-script execution, and the
+// number of goroutines alive at once is bounded by the pool rather than by
+// the number of entries in dir.
+func hashTree(h Hasher, dir string) ([]byte, error) {
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+	nodes := make([]treeEntry, len(entries))
+	errs := make([]error, len(entries))
+
+	jobs := make(chan int)
+	var wg sync.WaitGroup
+	digest := func(i int) {
+		e := entries[i]
+		info, err := e.Info()
+		if err != nil {
+			errs[i] = err
+			return
+		}
+		full := filepath.Join(dir, e.Name())
+		var digest []byte
+		switch {
+		case e.IsDir():
+			if err = Jobs.Walk.Acquire(); err != nil {
+				errs[i] = err
+				return
+			}
+			digest, err = hashTree(h, full)
+			Jobs.Walk.Release()
+		case info.Mode().IsRegular():
+			if err = Jobs.Work.AcquireCtx(context.Background()); err != nil {
+				errs[i] = err
+				return
+			}
+			digest, err = hashFile(h, full)
+			Jobs.Work.Release()
+		default:
+			return
+		}
+		if err != nil {
+			errs[i] = err
+			return
+		}
+		nodes[i] = treeEntry{name: e.Name(), mode: info.Mode(), digest: digest}
+	}
+
+	workers := jobCount()
+	if workers > len(entries) {
+		workers = len(entries)
+	}
+	for w := 0; w < workers; w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := range jobs {
+				digest(i)
+			}
+		}()
+	}
+	for i := range entries {
+		jobs <- i
+	}
+	close(jobs)
+	wg.Wait()
+	for _, err := range errs {
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	live := nodes[:0]
+	for _, n := range nodes {
+		if n.name != "" {
+			live = append(live, n)
+		}
+	}
+	sort.Slice(live, func(i, j int) bool { return live[i].name < live[j].name })
+
+	hh := h.New()
+	for _, n := range live {
+		fmt.Fprintf(hh, "%s\t%o\t", n.name, n.mode)
+		hh.Write(n.digest)
+	}
+	return hh.Sum(nil), nil
+}
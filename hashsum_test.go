@@ -0,0 +1,92 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func writeTree(t *testing.T, files map[string]string) string {
+	t.Helper()
+	root := t.TempDir()
+	for rel, content := range files {
+		full := filepath.Join(root, rel)
+		if err := os.MkdirAll(filepath.Dir(full), 0o755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(full, []byte(content), 0o644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return root
+}
+
+func TestHashDir(t *testing.T) {
+	base := map[string]string{
+		"a.txt":     "one",
+		"sub/b.txt": "two",
+		"sub/c.txt": "three",
+	}
+
+	cases := []struct {
+		name   string
+		files  map[string]string
+		wantEq bool // digest should equal base's
+	}{
+		{"identical tree hashes the same", base, true},
+		{"changing a nested file changes the digest", map[string]string{
+			"a.txt":     "one",
+			"sub/b.txt": "TWO",
+			"sub/c.txt": "three",
+		}, false},
+		{"renaming an entry changes the digest", map[string]string{
+			"a.txt":      "one",
+			"sub/b2.txt": "two",
+			"sub/c.txt":  "three",
+		}, false},
+		{"adding an entry changes the digest", map[string]string{
+			"a.txt":     "one",
+			"sub/b.txt": "two",
+			"sub/c.txt": "three",
+			"sub/d.txt": "four",
+		}, false},
+	}
+
+	baseDigest, err := HashDir(DefaultHasher, writeTree(t, base))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			got, err := HashDir(DefaultHasher, writeTree(t, c.files))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if (got == baseDigest) != c.wantEq {
+				t.Fatalf("HashDir() = %q, base = %q, wantEq = %v", got, baseDigest, c.wantEq)
+			}
+		})
+	}
+}
+
+func TestHashDirOrderIndependent(t *testing.T) {
+	// os.ReadDir already returns entries sorted by name, but HashDir's own
+	// sort.Slice is what actually guarantees combination order is stable
+	// regardless of directory read order -- build the same set of entries
+	// twice and confirm the digests match.
+	a := writeTree(t, map[string]string{"z.txt": "1", "a.txt": "2", "m.txt": "3"})
+	b := writeTree(t, map[string]string{"a.txt": "2", "m.txt": "3", "z.txt": "1"})
+
+	da, err := HashDir(DefaultHasher, a)
+	if err != nil {
+		t.Fatal(err)
+	}
+	db, err := HashDir(DefaultHasher, b)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if da != db {
+		t.Fatalf("HashDir() not order-independent: %q != %q", da, db)
+	}
+}
@@ -0,0 +1,183 @@
+package main
+
+import (
+	"context"
+	"os"
+	"runtime"
+	"strconv"
+	"strings"
+)
+
+// Gate is a counting semaphore bounding how many callers may hold it at
+// once. Acquire/AcquireCtx block until a slot is free (or ctx is done);
+// Release gives the slot back.
+type Gate interface {
+	Acquire() error
+	AcquireCtx(ctx context.Context) error
+	Release()
+}
+
+// localGate is a Gate backed by a buffered channel, usable only within this
+// process's own goroutines.
+type localGate chan struct{}
+
+func newLocalGate(n int) localGate {
+	return make(localGate, n)
+}
+
+func (g localGate) Acquire() error {
+	g <- struct{}{}
+	return nil
+}
+
+func (g localGate) AcquireCtx(ctx context.Context) error {
+	select {
+	case g <- struct{}{}:
+		return nil
+	case <-ctx.Done():
+		return context.Cause(ctx)
+	}
+}
+
+func (g localGate) Release() { <-g }
+
+// jobserverGate speaks the GNU make jobserver pipe protocol: acquiring reads
+// one token (a single byte) from the read end of the pipe make handed us,
+// and releasing writes it back. This lets redo share a job budget with a
+// `make -jN` (or another redo) parent instead of keeping its own, and the
+// read/write fds are handed down to do-scripts via build() so nested
+// redo-ifchange invocations see the same jobserver and cooperate too.
+type jobserverGate struct {
+	r, w *os.File
+}
+
+func (g *jobserverGate) Acquire() error {
+	buf := make([]byte, 1)
+	_, err := g.r.Read(buf)
+	return err
+}
+
+func (g *jobserverGate) AcquireCtx(ctx context.Context) error {
+	done := make(chan error, 1)
+	go func() {
+		buf := make([]byte, 1)
+		_, err := g.r.Read(buf)
+		done <- err
+	}()
+	select {
+	case err := <-done:
+		return err
+	case <-ctx.Done():
+		return context.Cause(ctx)
+	}
+}
+
+func (g *jobserverGate) Release() {
+	g.w.Write([]byte{'+'})
+}
+
+// Scheduler bounds concurrent work for one top-level redo invocation. Work
+// gates anything that consumes a file descriptor or a CPU core for real --
+// running a do-script and opening a file to hash it -- and is the one make
+// jobserver tokens stand in for when interop is active. Walk gates how many
+// dependency-graph / directory-tree recursions run concurrently; it is a
+// separate, always-local Gate so a goroutine already holding a Walk slot can
+// never block waiting on its own Work slot.
+type Scheduler struct {
+	Walk Gate
+	Work Gate
+}
+
+// Jobs is the scheduler for this redo invocation, built once in main(). Every
+// package that needs to bound concurrency reads this global, the same way
+// RedoTreeTime is read by anything that needs the invocation's start time.
+var Jobs = newScheduler()
+
+func newScheduler() *Scheduler {
+	n := jobCount()
+	// Re-export as REDO_JOBS so nested redo-ifchange invocations (which only
+	// inherit the environment, not os.Args) see the same job budget instead
+	// of each falling back to runtime.NumCPU() on its own.
+	os.Setenv("REDO_JOBS", strconv.Itoa(n))
+	work := Gate(newLocalGate(n))
+	if js, ok := detectJobserver(); ok {
+		work = js
+	}
+	return &Scheduler{
+		Walk: newLocalGate(n),
+		Work: work,
+	}
+}
+
+// jobCount resolves the local concurrency budget from -j/-jN on the command
+// line, then REDO_JOBS, then runtime.NumCPU().
+func jobCount() int {
+	for i, a := range os.Args[1:] {
+		if a == "-j" && i+2 < len(os.Args) {
+			if n, err := strconv.Atoi(os.Args[i+2]); err == nil && n > 0 {
+				return n
+			}
+		} else if val, ok := strings.CutPrefix(a, "-j"); ok && val != "" {
+			if n, err := strconv.Atoi(val); err == nil && n > 0 {
+				return n
+			}
+		}
+	}
+	if v := os.Getenv("REDO_JOBS"); v != "" {
+		if n, err := strconv.Atoi(v); err == nil && n > 0 {
+			return n
+		}
+	}
+	return runtime.NumCPU()
+}
+
+// stripJobFlag removes a -j/-jN argument (if any) from args, returning the
+// remaining arguments unchanged in order. jobCount() already consulted the
+// raw os.Args, so this just keeps -j from being mistaken for a build target.
+func stripJobFlag(args []string) []string {
+	rest := make([]string, 0, len(args))
+	for i := 0; i < len(args); i++ {
+		a := args[i]
+		if a == "-j" {
+			i++
+			continue
+		}
+		if _, ok := strings.CutPrefix(a, "-j"); ok {
+			continue
+		}
+		rest = append(rest, a)
+	}
+	return rest
+}
+
+// detectJobserver looks for a GNU make jobserver advertised in MAKEFLAGS
+// (--jobserver-auth=R,W, or the older --jobserver-fds=R,W) and wraps its
+// pipe fds in a jobserverGate.
+func detectJobserver() (*jobserverGate, bool) {
+	mf := os.Getenv("MAKEFLAGS")
+	if mf == "" {
+		return nil, false
+	}
+	for _, field := range strings.Fields(mf) {
+		for _, prefix := range []string{"--jobserver-auth=", "--jobserver-fds="} {
+			val, ok := strings.CutPrefix(field, prefix)
+			if !ok {
+				continue
+			}
+			r, w, ok := strings.Cut(val, ",")
+			if !ok {
+				continue
+			}
+			rfd, err1 := strconv.Atoi(r)
+			wfd, err2 := strconv.Atoi(w)
+			if err1 != nil || err2 != nil {
+				continue
+			}
+			return &jobserverGate{
+				r: os.NewFile(uintptr(rfd), "jobserver-r"),
+				w: os.NewFile(uintptr(wfd), "jobserver-w"),
+			}, true
+		}
+	}
+	return nil, false
+}
@@ -0,0 +1,27 @@
+package main
+
+import (
+	"os"
+	"testing"
+)
+
+// newScheduler re-exports its resolved job count as REDO_JOBS so that a
+// do-script's nested redo-ifchange invocations, which only inherit the
+// environment (not os.Args), share the same budget instead of each falling
+// back to runtime.NumCPU() on its own.
+func TestNewSchedulerExportsREDOJOBS(t *testing.T) {
+	old, hadOld := os.LookupEnv("REDO_JOBS")
+	defer func() {
+		if hadOld {
+			os.Setenv("REDO_JOBS", old)
+		} else {
+			os.Unsetenv("REDO_JOBS")
+		}
+	}()
+
+	os.Setenv("REDO_JOBS", "3")
+	newScheduler()
+	if got := os.Getenv("REDO_JOBS"); got != "3" {
+		t.Fatalf("REDO_JOBS = %q, want %q", got, "3")
+	}
+}
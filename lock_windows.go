@@ -0,0 +1,22 @@
+//go:build windows
+
+package main
+
+import (
+	"os"
+	"syscall"
+)
+
+// lockFile takes an exclusive advisory lock on f, blocking until it is
+// available. Windows releases the lock automatically when the owning
+// process exits, so a lock can never be left stale the way a
+// lockfile-as-marker can.
+func lockFile(f *os.File) error {
+	ol := new(syscall.Overlapped)
+	return syscall.LockFileEx(syscall.Handle(f.Fd()), syscall.LOCKFILE_EXCLUSIVE_LOCK, 0, 1, 0, ol)
+}
+
+func unlockFile(f *os.File) error {
+	ol := new(syscall.Overlapped)
+	return syscall.UnlockFileEx(syscall.Handle(f.Fd()), 0, 1, 0, ol)
+}
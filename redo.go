@@ -24,6 +24,7 @@ func main() {
 	log.SetFlags(0)
 	progName := filepath.Base(os.Args[0])
 	log.SetPrefix(progName + ": ")
+	defer removeStagingRoot()
 
 	t := os.Getenv(RedoTreeTimeEnv)
 	if t == "" {
@@ -48,7 +49,7 @@ func main() {
 
 	switch progName {
 	case "redo":
-		for _, arg := range os.Args[1:] {
+		for _, arg := range stripJobFlag(stripTraceFlag(os.Args[1:])) {
 			n, err := NewNode(arg)
 			if err != nil {
 				cancelCause(fmt.Errorf("failed to stat %s: %v", arg, err))
@@ -73,11 +74,6 @@ func main() {
 		if parent == "" {
 			log.Fatalln("redo-ifchange should be called from a do script")
 		}
-		prereqsFile, err := os.OpenFile(parent+".prereqs", os.O_APPEND|os.O_WRONLY, 0666)
-		if err != nil {
-			log.Fatalln("unable to append to prereqs file for", RedoParentEnv, err)
-		}
-		defer prereqsFile.Close()
 		for _, arg := range os.Args[1:] {
 			n, err := NewNode(arg)
 			if err != nil {
@@ -94,7 +90,7 @@ func main() {
 			}()
 		}
 		wg.Wait()
-		if err = context.Cause(ctx); err != nil {
+		if err := context.Cause(ctx); err != nil {
 			log.Fatalln(err)
 		}
 		for _, arg := range os.Args[1:] {
@@ -102,8 +98,7 @@ func main() {
 			if err != nil {
 				log.Fatalln("failed to stat", arg, err)
 			}
-			err = n.AddDep(prereqsFile)
-			if err != nil {
+			if err = n.AddDep(parent); err != nil {
 				log.Fatalln("unable to add dependency:", err)
 			}
 		}
@@ -122,16 +117,84 @@ func main() {
 				log.Fatalln("while building", n.Dir+n.File, err)
 			}
 		}
-		prereqsFile, err := os.OpenFile(parent+".prereqs", os.O_APPEND|os.O_WRONLY, 0666)
-		if err != nil {
-			log.Fatalln("unable to append to prereqs file for", RedoParentEnv, err)
+		for _, arg := range os.Args[1:] {
+			if err := database().AppendDep(parent, DepRecord{Path: arg, Kind: DepIfCreate}); err != nil {
+				log.Fatalln("unable to add ifcreate dep:", err)
+			}
 		}
-		defer prereqsFile.Close()
+	case "redo-log":
 		for _, arg := range os.Args[1:] {
-			_, err = fmt.Fprintf(prereqsFile, "%s	ifcreate\n", arg)
+			n, err := NewNode(arg)
 			if err != nil {
-				log.Fatalln("unable to add ifcreate dep:", err)
+				log.Fatalln("failed to stat", arg, err)
+			}
+			runs, err := database().Runs(n.AbsPath)
+			if err != nil {
+				log.Fatalln("failed to read run history for", arg, err)
+			}
+			for _, run := range runs {
+				fmt.Printf("%s\t%s\t%s\texit=%d\tstdout_bytes=%d\n",
+					arg, run.Started.Format(time.RFC3339), run.Finished.Format(time.RFC3339),
+					run.ExitCode, run.StdoutBytes)
+			}
+		}
+	case "redo-deps":
+		args := os.Args[1:]
+		if len(args) > 0 && args[0] == "-rev" {
+			for _, arg := range args[1:] {
+				n, err := NewNode(arg)
+				if err != nil {
+					log.Fatalln("failed to stat", arg, err)
+				}
+				targets, err := database().Dependents(n.AbsPath)
+				if err != nil {
+					log.Fatalln("failed to read dependents for", arg, err)
+				}
+				for _, t := range targets {
+					fmt.Println(t)
+				}
 			}
+			break
+		}
+		fmt.Println("digraph redo {")
+		seen := make(map[string]bool)
+		for _, arg := range args {
+			n, err := NewNode(arg)
+			if err != nil {
+				log.Fatalln("failed to stat", arg, err)
+			}
+			if err = writeDepsDot(os.Stdout, n, seen); err != nil {
+				log.Fatalln("failed to read deps for", arg, err)
+			}
+		}
+		fmt.Println("}")
+	case "redo-cache-gc":
+		cache := cacheFromEnv()
+		if cache == nil {
+			log.Fatalln("REDO_CACHE_URL is not set, nothing to garbage-collect")
+		}
+		live := make(map[string]bool)
+		for _, arg := range os.Args[1:] {
+			n, err := NewNode(arg)
+			if err != nil {
+				log.Fatalln("failed to stat", arg, err)
+			}
+			deps, err := database().Deps(n.AbsPath)
+			if err != nil {
+				log.Fatalln("failed to read deps for", arg, err)
+			}
+			do, err := NewNode(n.Dir + n.DoScript)
+			if err != nil {
+				log.Fatalln("failed to stat do script for", arg, err)
+			}
+			h, err := do.Hash()
+			if err != nil {
+				log.Fatalln("failed to hash do script for", arg, err)
+			}
+			live[computeCacheKey(n.AbsPath, h, deps)] = true
+		}
+		if err := cacheGC(cache, live); err != nil {
+			log.Fatalln("cache gc failed:", err)
 		}
 	case "stop-ifchange":
 		for _, arg := range os.Args[1:] {
@@ -0,0 +1,299 @@
+package main
+
+import (
+	"bytes"
+	"encoding/gob"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"sort"
+	"strings"
+)
+
+// CacheManifest is the small sidecar PUT alongside a cached artifact,
+// recording enough to audit a cache hit without re-downloading the blob.
+type CacheManifest struct {
+	Deps         []DepRecord
+	ExitCode     int
+	StderrDigest string
+}
+
+// RemoteCache is a content-addressable blob store for build artifacts,
+// keyed by computeCacheKey's digest of everything that determines the
+// artifact's content: the do-script, every ifchange dependency, the
+// ordered ifcreate list and the target's own path. httpRemoteCache's
+// GET/PUT protocol mirrors restic/bazel-remote conventions closely enough
+// that a static file server with WebDAV PUT, or a tiny daemon, suffices.
+type RemoteCache interface {
+	// Get streams the cached artifact for key into dest. hit is false (with
+	// a nil error) on a cache miss.
+	Get(key string, dest io.Writer) (hit bool, err error)
+	// Put uploads the artifact read from src and its manifest under key.
+	Put(key string, manifest CacheManifest, src io.Reader) error
+}
+
+// httpRemoteCache implements RemoteCache against a plain HTTP(S) blob
+// store: GET/PUT <baseURL>/cas/<key> for the artifact itself, the same path
+// plus ".manifest" for the gob-encoded CacheManifest, and <baseURL>/cas/index
+// for a newline-delimited list of every key ever Put, which is what lets
+// redo-cache-gc enumerate and delete over a server with no listing API of
+// its own.
+type httpRemoteCache struct {
+	baseURL  string
+	username string
+	password string
+	client   *http.Client
+}
+
+// cacheFromEnv returns the configured RemoteCache, or nil if REDO_CACHE_URL
+// is unset, in which case callers skip straight to a normal build -- the
+// whole feature is a no-op until that variable is set.
+func cacheFromEnv() RemoteCache {
+	raw := os.Getenv("REDO_CACHE_URL")
+	if raw == "" {
+		return nil
+	}
+	u, err := url.Parse(raw)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "redo: invalid REDO_CACHE_URL, disabling remote cache:", err)
+		return nil
+	}
+	c := &httpRemoteCache{client: http.DefaultClient}
+	if u.User != nil {
+		c.username = u.User.Username()
+		c.password, _ = u.User.Password()
+		u.User = nil
+	}
+	c.baseURL = strings.TrimSuffix(u.String(), "/")
+	return c
+}
+
+func (c *httpRemoteCache) blobURL(key string) string     { return c.baseURL + "/cas/" + key }
+func (c *httpRemoteCache) manifestURL(key string) string { return c.baseURL + "/cas/" + key + ".manifest" }
+func (c *httpRemoteCache) indexURL() string              { return c.baseURL + "/cas/index" }
+
+func (c *httpRemoteCache) setAuth(req *http.Request) {
+	if c.username != "" || c.password != "" {
+		req.SetBasicAuth(c.username, c.password)
+	}
+}
+
+func (c *httpRemoteCache) Get(key string, dest io.Writer) (bool, error) {
+	req, err := http.NewRequest(http.MethodGet, c.blobURL(key), nil)
+	if err != nil {
+		return false, err
+	}
+	c.setAuth(req)
+	resp, err := c.client.Do(req)
+	if err != nil {
+		return false, err
+	}
+	defer resp.Body.Close()
+	switch resp.StatusCode {
+	case http.StatusOK:
+		_, err = io.Copy(dest, resp.Body)
+		return err == nil, err
+	case http.StatusNotFound:
+		return false, nil
+	default:
+		return false, fmt.Errorf("cache GET %s: unexpected status %s", c.blobURL(key), resp.Status)
+	}
+}
+
+func (c *httpRemoteCache) Put(key string, manifest CacheManifest, src io.Reader) error {
+	if err := c.putBlob(c.blobURL(key), src); err != nil {
+		return err
+	}
+	var buf bytes.Buffer
+	if err := gob.NewEncoder(&buf).Encode(manifest); err != nil {
+		return err
+	}
+	if err := c.putBlob(c.manifestURL(key), &buf); err != nil {
+		return err
+	}
+	return c.addToIndex(key)
+}
+
+// readIndex fetches the newline-delimited list of every key Put has ever
+// recorded. A 404 (nothing uploaded yet) is an empty index, not an error.
+func (c *httpRemoteCache) readIndex() ([]string, error) {
+	req, err := http.NewRequest(http.MethodGet, c.indexURL(), nil)
+	if err != nil {
+		return nil, err
+	}
+	c.setAuth(req)
+	resp, err := c.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	switch resp.StatusCode {
+	case http.StatusOK:
+		body, err := io.ReadAll(resp.Body)
+		if err != nil {
+			return nil, err
+		}
+		var keys []string
+		for _, line := range strings.Split(strings.TrimSpace(string(body)), "\n") {
+			if line != "" {
+				keys = append(keys, line)
+			}
+		}
+		return keys, nil
+	case http.StatusNotFound:
+		return nil, nil
+	default:
+		return nil, fmt.Errorf("cache GET %s: unexpected status %s", c.indexURL(), resp.Status)
+	}
+}
+
+func (c *httpRemoteCache) writeIndex(keys []string) error {
+	return c.putBlob(c.indexURL(), strings.NewReader(strings.Join(keys, "\n")+"\n"))
+}
+
+// addToIndex appends key to the index if it isn't already there. Two Puts
+// racing on the index both read-then-write without a lock, so a concurrent
+// writer's addition can be lost; the index is a GC aid, not a correctness
+// dependency, and a leftover un-indexed blob is just never collected rather
+// than wrongly deleted.
+func (c *httpRemoteCache) addToIndex(key string) error {
+	keys, err := c.readIndex()
+	if err != nil {
+		return err
+	}
+	for _, k := range keys {
+		if k == key {
+			return nil
+		}
+	}
+	return c.writeIndex(append(keys, key))
+}
+
+// ListKeys implements the lister interface cacheGC uses, backed by the
+// manifest-index file Put maintains alongside the blobs themselves.
+func (c *httpRemoteCache) ListKeys() ([]string, error) {
+	return c.readIndex()
+}
+
+// Delete removes key's blob, manifest, and index entry. A 404 on the blob
+// or manifest is not an error: the point is that they're gone afterward.
+func (c *httpRemoteCache) Delete(key string) error {
+	if err := c.deleteBlob(c.blobURL(key)); err != nil {
+		return err
+	}
+	if err := c.deleteBlob(c.manifestURL(key)); err != nil {
+		return err
+	}
+	keys, err := c.readIndex()
+	if err != nil {
+		return err
+	}
+	kept := keys[:0]
+	for _, k := range keys {
+		if k != key {
+			kept = append(kept, k)
+		}
+	}
+	return c.writeIndex(kept)
+}
+
+func (c *httpRemoteCache) deleteBlob(url string) error {
+	req, err := http.NewRequest(http.MethodDelete, url, nil)
+	if err != nil {
+		return err
+	}
+	c.setAuth(req)
+	resp, err := c.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	switch resp.StatusCode {
+	case http.StatusOK, http.StatusNoContent, http.StatusNotFound:
+		return nil
+	default:
+		return fmt.Errorf("cache DELETE %s: unexpected status %s", url, resp.Status)
+	}
+}
+
+func (c *httpRemoteCache) putBlob(url string, src io.Reader) error {
+	req, err := http.NewRequest(http.MethodPut, url, src)
+	if err != nil {
+		return err
+	}
+	c.setAuth(req)
+	resp, err := c.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	switch resp.StatusCode {
+	case http.StatusOK, http.StatusCreated, http.StatusNoContent:
+		return nil
+	default:
+		return fmt.Errorf("cache PUT %s: unexpected status %s", url, resp.Status)
+	}
+}
+
+// computeCacheKey digests everything that determines a target's artifact
+// content: the do-script's own hash, every ifchange dependency's expected
+// digest (sorted, so recording order doesn't affect the key), the ordered
+// ifcreate list, and the target's own path, which disambiguates two
+// targets built by the same default.do from colliding.
+func computeCacheKey(target, doHash string, deps []DepRecord) string {
+	var ifchange, ifcreate []string
+	for _, dep := range deps {
+		switch dep.Kind {
+		case DepIfChange:
+			ifchange = append(ifchange, dep.Path+"="+dep.ExpectedDigest)
+		case DepIfCreate:
+			ifcreate = append(ifcreate, dep.Path)
+		}
+	}
+	sort.Strings(ifchange)
+
+	h := DefaultHasher.New()
+	fmt.Fprintf(h, "do:%s\n", doHash)
+	for _, e := range ifchange {
+		fmt.Fprintf(h, "ifchange:%s\n", e)
+	}
+	for _, e := range ifcreate {
+		fmt.Fprintf(h, "ifcreate:%s\n", e)
+	}
+	fmt.Fprintf(h, "target:%s\n", target)
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+// cacheGC deletes every cached blob whose key is not in live, the set of
+// cache keys computeCacheKey would produce for the tree's current targets.
+// It backs the redo-cache-gc subcommand; a RemoteCache that can't list its
+// own keyspace simply has nothing to collect, since there is no local index
+// of what's out there (httpRemoteCache can, via the manifest-index file its
+// own Put maintains).
+func cacheGC(cache RemoteCache, live map[string]bool) error {
+	type lister interface {
+		ListKeys() ([]string, error)
+		Delete(key string) error
+	}
+	l, ok := cache.(lister)
+	if !ok {
+		fmt.Fprintln(os.Stderr, "redo-cache-gc: this cache backend cannot list or delete blobs, nothing to do")
+		return nil
+	}
+	keys, err := l.ListKeys()
+	if err != nil {
+		return err
+	}
+	for _, key := range keys {
+		if live[key] {
+			continue
+		}
+		if err := l.Delete(key); err != nil {
+			return err
+		}
+	}
+	return nil
+}
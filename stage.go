@@ -0,0 +1,74 @@
+package main
+
+import (
+	"fmt"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"sync"
+	"sync/atomic"
+)
+
+// stagingRoot is this invocation's private work directory for in-progress
+// build() outputs, so they never live next to their sources under a name
+// like "redo-stdout---<file>": ".redo/tmp/<pid>-<rand>", relative to wherever
+// redo was invoked. It is created lazily on first use.
+var (
+	stagingRootOnce sync.Once
+	stagingRootPath string
+	buildSeq        int64
+)
+
+func stagingRoot() string {
+	stagingRootOnce.Do(func() {
+		stagingRootPath = filepath.Join(".redo", "tmp", fmt.Sprintf("%d-%08x", os.Getpid(), rand.Uint32()))
+	})
+	return stagingRootPath
+}
+
+// removeStagingRoot best-effort removes this invocation's entire staging
+// root, not just the per-build subdirectories build() already cleans up as
+// it goes: without this, the root itself (created once by the first
+// newStageDir call) survives every invocation as an empty directory under
+// .redo/tmp, which is the same tree-pollution problem staging was meant to
+// fix. Call it once, as the top-level command in redo.go finishes. A no-op
+// if this invocation never staged a build.
+func removeStagingRoot() {
+	if stagingRootPath == "" {
+		return
+	}
+	os.RemoveAll(stagingRootPath)
+}
+
+// newStageDir creates and returns a fresh, absolute, per-build subdirectory
+// of stagingRoot. Giving every build() call its own subdirectory means two
+// parallel builds of same-named targets in sibling directories can never
+// collide the way the old "redo-stdout---<file>" naming could.
+func newStageDir() (string, error) {
+	id := atomic.AddInt64(&buildSeq, 1)
+	dir, err := filepath.Abs(filepath.Join(stagingRoot(), fmt.Sprintf("%d", id)))
+	if err != nil {
+		return "", err
+	}
+	if err := os.MkdirAll(dir, 0777); err != nil {
+		return "", err
+	}
+	return dir, nil
+}
+
+// fsyncDir fsyncs a directory's own entry, which on most filesystems is the
+// only way to make sure a file created or renamed within it actually
+// survives a crash. An empty dir means the current directory -- that's what
+// filepath.Split leaves n.Dir as for a top-level target -- not a path
+// os.Open can resolve, so it's treated the same as "."
+func fsyncDir(dir string) error {
+	if dir == "" {
+		dir = "."
+	}
+	d, err := os.Open(dir)
+	if err != nil {
+		return err
+	}
+	defer d.Close()
+	return d.Sync()
+}
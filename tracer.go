@@ -0,0 +1,203 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"log"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"regexp"
+	"strings"
+)
+
+// RedoTraceEnv, once set by the top-level "redo -trace" invocation, is
+// inherited by every redo-ifchange/build() descendant (build() already
+// copies os.Environ() into the do-script's environment), the same way
+// RedoTreeTimeEnv keeps the whole subtree on one start time.
+const RedoTraceEnv = "REDOTRACE"
+
+// Tracer discovers the files a do-script reads or stats by observing the
+// running process, instead of relying on it to call redo-ifchange /
+// redo-ifcreate itself. This lets unmodified make/cmake/shell-script builds
+// participate in redo's dependency tracking under "redo -trace".
+type Tracer interface {
+	Name() string
+	// Trace runs cmd to completion, capturing every path it opened or
+	// stat'd. existing holds paths that were present when accessed (ifchange
+	// candidates); missing holds paths that were not (ifcreate candidates).
+	Trace(cmd *exec.Cmd) (existing, missing []string, err error)
+}
+
+// noopTracer runs cmd normally and discovers nothing. It's the fallback
+// when no working backend is available on this platform.
+type noopTracer struct{}
+
+func (noopTracer) Name() string { return "none" }
+func (noopTracer) Trace(cmd *exec.Cmd) (existing, missing []string, err error) {
+	return nil, nil, cmd.Run()
+}
+
+// fuseTracer is the design's preferred backend -- mount a FUSE overlay over
+// the working directory and record every open() that passes through it --
+// but it needs a FUSE library (e.g. bazil.org/fuse) that this dependency-
+// free module cannot vendor, so Trace always fails and selectTracer() never
+// picks it. It's kept here, satisfying the Tracer interface, so the backend
+// exists to slot in a real implementation without touching call sites.
+type fuseTracer struct{}
+
+func (fuseTracer) Name() string { return "fuse" }
+func (fuseTracer) Trace(cmd *exec.Cmd) (existing, missing []string, err error) {
+	return nil, nil, fmt.Errorf("fuse tracer: not available without a FUSE library dependency")
+}
+
+// straceOpenRE matches one strace -qq output line for open/openat/stat/
+// lstat/newfstatat/access: the first string literal is the path argument,
+// and the final number is the call's return value (-1 on ENOENT et al).
+var straceOpenRE = regexp.MustCompile(`^[a-z0-9_]+\("([^"]*)".*=\s*(-?\d+)`)
+
+// straceTracer shells out to the strace(1) binary and parses its output.
+// It works anywhere strace is installed, needs no special privileges beyond
+// ptrace, and is Linux-only because strace is.
+type straceTracer struct{}
+
+func (straceTracer) Name() string { return "strace" }
+
+func (straceTracer) Trace(cmd *exec.Cmd) (existing, missing []string, err error) {
+	traceFile, err := os.CreateTemp("", "redo-strace-*.log")
+	if err != nil {
+		return nil, nil, err
+	}
+	tracePath := traceFile.Name()
+	traceFile.Close()
+	defer os.Remove(tracePath)
+
+	args := []string{
+		"-f", "-qq",
+		"-e", "trace=open,openat,stat,lstat,newfstatat,access",
+		"-o", tracePath,
+		"--", cmd.Path,
+	}
+	args = append(args, cmd.Args[1:]...)
+	traced := exec.Command("strace", args...)
+	traced.Dir = cmd.Dir
+	traced.Env = cmd.Env
+	traced.Stdout = cmd.Stdout
+	traced.Stderr = cmd.Stderr
+	traced.ExtraFiles = cmd.ExtraFiles
+	traced.Cancel = cmd.Cancel
+
+	runErr := traced.Run()
+
+	f, openErr := os.Open(tracePath)
+	if openErr != nil {
+		if runErr != nil {
+			return nil, nil, runErr
+		}
+		return nil, nil, openErr
+	}
+	defer f.Close()
+
+	seen := make(map[string]bool)
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		m := straceOpenRE.FindStringSubmatch(scanner.Text())
+		if m == nil || m[1] == "" || seen[m[1]] {
+			continue
+		}
+		seen[m[1]] = true
+		if m[2] == "-1" {
+			missing = append(missing, m[1])
+		} else {
+			existing = append(existing, m[1])
+		}
+	}
+	return existing, missing, runErr
+}
+
+// selectTracer picks the best Tracer backend this platform and environment
+// actually support, falling back to noopTracer (with a warning, since the
+// caller asked for tracing) rather than failing the build outright.
+func selectTracer() Tracer {
+	if t := platformTracer(); t != nil {
+		return t
+	}
+	log.Println("trace: no working tracer backend on this platform, building untraced")
+	return noopTracer{}
+}
+
+// traceIgnorePrefixes filters out system paths a do-script typically opens
+// (shared libraries, /etc, /proc) that aren't meaningfully a dependency of
+// the target and would otherwise turn every traced build into a sea of
+// ifcreate entries for things like /etc/ld.so.cache.
+var traceIgnorePrefixes = []string{"/proc/", "/sys/", "/dev/", "/usr/", "/lib/", "/lib64/", "/etc/", os.TempDir()}
+
+func traceShouldIgnore(path string) bool {
+	for _, prefix := range traceIgnorePrefixes {
+		if strings.HasPrefix(path, prefix) {
+			return true
+		}
+	}
+	return false
+}
+
+// recordTracedDeps merges paths discovered by a Tracer into n's recorded
+// dependencies, skipping the target's own output, its do-script (already
+// recorded explicitly), traced system paths, and anything outside n.Dir --
+// a tracer has no notion of "this is redo's business", so it's on this
+// method to apply the same scoping redo-ifchange/redo-ifcreate would have.
+func (n *Node) recordTracedDeps(existing, missing []string) error {
+	self := filepath.Clean(n.Dir + n.File)
+	doPath := filepath.Clean(n.Dir + n.DoScript)
+
+	relIn := func(path string) (string, bool) {
+		path = filepath.Clean(path)
+		if path == self || path == doPath || traceShouldIgnore(path) {
+			return "", false
+		}
+		rel, err := filepath.Rel(n.Dir, path)
+		if err != nil || strings.HasPrefix(rel, "..") {
+			return "", false
+		}
+		return rel, true
+	}
+
+	for _, path := range existing {
+		rel, ok := relIn(path)
+		if !ok {
+			continue
+		}
+		o, err := NewNode(n.Dir + rel)
+		if err != nil || !o.Exists {
+			continue
+		}
+		if err := o.AddDep(n.AbsPath); err != nil {
+			return err
+		}
+	}
+	for _, path := range missing {
+		rel, ok := relIn(path)
+		if !ok {
+			continue
+		}
+		if err := database().AppendDep(n.AbsPath, DepRecord{Path: rel, Kind: DepIfCreate}); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// stripTraceFlag removes a "-trace" argument (if any) from args, enabling
+// tracing for the rest of this invocation's subtree as a side effect, the
+// way stripJobFlag handles -j.
+func stripTraceFlag(args []string) []string {
+	rest := make([]string, 0, len(args))
+	for _, a := range args {
+		if a == "-trace" {
+			os.Setenv(RedoTraceEnv, "1")
+			continue
+		}
+		rest = append(rest, a)
+	}
+	return rest
+}
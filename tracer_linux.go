@@ -0,0 +1,149 @@
+//go:build linux
+
+package main
+
+import (
+	"fmt"
+	"os"
+	"os/exec"
+	"syscall"
+	"unsafe"
+)
+
+// fanotify flag values from <linux/fanotify.h>, reproduced here because the
+// standard library's syscall package numbers the fanotify syscalls
+// (SYS_FANOTIFY_INIT, SYS_FANOTIFY_MARK) but doesn't name their flags.
+const (
+	fanClassContent = 0x04
+	fanCloexec      = 0x01
+	fanNonblock     = 0x02
+	fanMarkAdd      = 0x01
+	fanMarkMount    = 0x10
+	fanOpen         = 0x00000020
+	fanOndir        = 0x40000000
+	fanEventOnChild = 0x08000000
+)
+
+// atFdcwd is AT_FDCWD, passed as the directory fd when fanotify_mark is
+// given an absolute path. It's a var, not a const: -100 isn't representable
+// by uintptr, so the uintptr(atFdcwd) conversion below relies on the
+// non-constant (two's-complement, wraparound) conversion rule rather than
+// the constant one, which would fail to compile.
+var atFdcwd = int(-100)
+
+type fanotifyEventMetadata struct {
+	Length      uint32
+	Version     uint8
+	Reserved    uint8
+	MetadataLen uint16
+	Mask        uint64
+	Fd          int32
+	Pid         int32
+}
+
+// fanotifyTracer watches opens under the do-script's working directory via
+// the kernel's fanotify API. It needs CAP_SYS_ADMIN (or an unprivileged
+// fanotify build on newer kernels) for a mount-wide mark, so it routinely
+// fails to initialise in a container or CI runner; selectTracer() treats
+// that as "unavailable" and falls back rather than failing the build.
+type fanotifyTracer struct{}
+
+func (fanotifyTracer) Name() string { return "fanotify" }
+
+func newFanotifyFD() (int, error) {
+	fd, _, errno := syscall.Syscall(syscall.SYS_FANOTIFY_INIT,
+		uintptr(fanClassContent|fanCloexec|fanNonblock), uintptr(os.O_RDONLY), 0)
+	if errno != 0 {
+		return -1, errno
+	}
+	return int(fd), nil
+}
+
+func fanotifyMark(fd int, path string) error {
+	p, err := syscall.BytePtrFromString(path)
+	if err != nil {
+		return err
+	}
+	_, _, errno := syscall.Syscall6(syscall.SYS_FANOTIFY_MARK,
+		uintptr(fd),
+		uintptr(fanMarkAdd|fanMarkMount),
+		uintptr(fanOpen|fanOndir|fanEventOnChild),
+		uintptr(atFdcwd),
+		uintptr(unsafe.Pointer(p)),
+		0)
+	if errno != 0 {
+		return errno
+	}
+	return nil
+}
+
+func (fanotifyTracer) Trace(cmd *exec.Cmd) (existing, missing []string, err error) {
+	fd, ferr := newFanotifyFD()
+	if ferr != nil {
+		return nil, nil, fmt.Errorf("fanotify_init: %w", ferr)
+	}
+	dir := cmd.Dir
+	if dir == "" {
+		if dir, ferr = os.Getwd(); ferr != nil {
+			syscall.Close(fd)
+			return nil, nil, ferr
+		}
+	}
+	if merr := fanotifyMark(fd, dir); merr != nil {
+		syscall.Close(fd)
+		return nil, nil, fmt.Errorf("fanotify_mark: %w", merr)
+	}
+	f := os.NewFile(uintptr(fd), "fanotify")
+
+	seen := make(map[string]bool)
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		buf := make([]byte, 4096)
+		metaSize := int(unsafe.Sizeof(fanotifyEventMetadata{}))
+		for {
+			n, rerr := f.Read(buf)
+			if rerr != nil || n < metaSize {
+				return
+			}
+			off := 0
+			for off+metaSize <= n {
+				ev := (*fanotifyEventMetadata)(unsafe.Pointer(&buf[off]))
+				if ev.Fd >= 0 {
+					if path, lerr := os.Readlink(fmt.Sprintf("/proc/self/fd/%d", ev.Fd)); lerr == nil && !seen[path] {
+						seen[path] = true
+						if _, statErr := os.Stat(path); statErr == nil {
+							existing = append(existing, path)
+						} else {
+							missing = append(missing, path)
+						}
+					}
+					syscall.Close(int(ev.Fd))
+				}
+				if ev.Length == 0 {
+					return
+				}
+				off += int(ev.Length)
+			}
+		}
+	}()
+
+	err = cmd.Run()
+	f.Close()
+	<-done
+	return existing, missing, err
+}
+
+// platformTracer prefers fanotify (no extra binary required) and falls
+// back to shelling out to strace, returning nil if neither is usable so
+// selectTracer() can fall back to an untraced build.
+func platformTracer() Tracer {
+	if fd, err := newFanotifyFD(); err == nil {
+		syscall.Close(fd)
+		return fanotifyTracer{}
+	}
+	if _, err := exec.LookPath("strace"); err == nil {
+		return straceTracer{}
+	}
+	return nil
+}
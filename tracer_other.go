@@ -0,0 +1,10 @@
+//go:build !linux
+
+package main
+
+// platformTracer has no backend outside Linux: fanotify and strace are
+// both Linux-specific, and FUSE remains unimplemented everywhere (see
+// fuseTracer in tracer.go). selectTracer() falls back to an untraced build.
+func platformTracer() Tracer {
+	return nil
+}